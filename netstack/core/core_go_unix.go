@@ -4,21 +4,185 @@ package core
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/eyasliu/shadow/netstack/netutil"
 )
 
+// BatchSize is the number of packets read or written in a single batched syscall
+// when the underlying Device supports it.
+const BatchSize = 64
+
+// BatchReader is implemented by devices that can fill several packet buffers in a
+// single call, e.g. through readv.
+type BatchReader interface {
+	ReadBatch(bufs [][]byte, sizes []int) (n int, err error)
+}
+
+// BatchWriter is implemented by devices that can flush several packets in a
+// single call, e.g. through writev.
+type BatchWriter interface {
+	WriteBatch(bufs [][]byte) (int, error)
+}
+
+// PacketIO abstracts over how an Endpoint's backend delivers and accepts
+// packets, so the ingest/egress paths don't need to special-case each
+// backend's framing: headroom is the number of bytes of leading per-backend
+// header ReadPacket/WritePacket expect to read past or write before (4 for
+// the unix tun's PI prefix, 0 for WinTun and WinDivert).
+type PacketIO interface {
+	// ReadPacket fills buf starting at offset headroom and returns the
+	// payload length and the offset it was written at.
+	ReadPacket(buf []byte, headroom int) (n, offset int, err error)
+	// WritePacket writes buf[offset:] to the backend.
+	WritePacket(buf []byte, offset int) (int, error)
+}
+
+// unixHeadroom is the 4-byte PI prefix unix tun devices read and write past.
+const unixHeadroom = 4
+
+// unixPacketIO adapts a unix tun's ReaderOffset/WriterOffset pair to
+// PacketIO.
+type unixPacketIO struct {
+	r ReaderOffset
+	w WriterOffset
+}
+
+// ReadPacket is ...
+func (io unixPacketIO) ReadPacket(buf []byte, headroom int) (int, int, error) {
+	n, err := io.r.ReadOffset(buf, headroom)
+	return n, headroom, err
+}
+
+// WritePacket is ...
+func (io unixPacketIO) WritePacket(buf []byte, offset int) (int, error) {
+	return io.w.WriteOffset(buf, offset)
+}
+
+// EndpointStats are running packet counters for an Endpoint, useful for
+// observing allocation pressure and drop rates; fetch a consistent snapshot
+// with Endpoint.Stats. Fields are updated with atomic ops and must stay
+// first in Endpoint for 64-bit alignment on 32-bit platforms.
+type EndpointStats struct {
+	PacketsIn  uint64
+	PacketsOut uint64
+	Drops      uint64
+	PoolHits   uint64
+	PoolMisses uint64
+}
+
 // Endpoint is ...
 type Endpoint struct {
+	stats EndpointStats
+
 	*channel.Endpoint
 	mtu int
 	dev Device
 	buf []byte
 	mu  sync.Mutex
-	wt  WriterOffset
+	io  PacketIO
+
+	bufPool sync.Pool
+
+	br    BatchReader
+	bw    BatchWriter
+	rbufs [][]byte
+	rsize []int
+
+	gro *netutil.GROTable
+	tso bool
+
+	ingress *netutil.Chain
+	egress  *netutil.Chain
+
+	tap *netutil.Tap
+}
+
+// Stats returns a consistent snapshot of the endpoint's packet counters.
+func (e *Endpoint) Stats() EndpointStats {
+	return EndpointStats{
+		PacketsIn:  atomic.LoadUint64(&e.stats.PacketsIn),
+		PacketsOut: atomic.LoadUint64(&e.stats.PacketsOut),
+		Drops:      atomic.LoadUint64(&e.stats.Drops),
+		PoolHits:   atomic.LoadUint64(&e.stats.PoolHits),
+		PoolMisses: atomic.LoadUint64(&e.stats.PoolMisses),
+	}
+}
+
+// getBuf returns a headroom+mtu buffer from the pool, allocating a new one
+// on a miss.
+func (e *Endpoint) getBuf() []byte {
+	if v := e.bufPool.Get(); v != nil {
+		atomic.AddUint64(&e.stats.PoolHits, 1)
+		return v.([]byte)
+	}
+	atomic.AddUint64(&e.stats.PoolMisses, 1)
+	return make([]byte, unixHeadroom+e.mtu)
+}
+
+// putBuf returns buf to the pool for reuse by the next read.
+func (e *Endpoint) putBuf(buf []byte) {
+	e.bufPool.Put(buf)
+}
+
+// UseIngressHook registers h to run on every packet before it is injected
+// into the stack, in the order hooks are registered.
+func (e *Endpoint) UseIngressHook(h netutil.PacketHook) {
+	e.ingress.Use(h)
+}
+
+// UseEgressHook registers h to run on every packet before it is written back
+// to the device, in the order hooks are registered.
+func (e *Endpoint) UseEgressHook(h netutil.PacketHook) {
+	e.egress.Use(h)
+}
+
+// Capabilities reports CapabilityHardwareGSO on top of the embedded
+// channel.Endpoint's capabilities when TSO is enabled, so the stack knows it
+// may hand WriteNotify oversized writes for SegmentTCP to split; without it
+// gVisor never produces anything bigger than mtu and TSO is unreachable.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	caps := e.Endpoint.Capabilities()
+	if e.tso {
+		caps |= stack.CapabilityHardwareGSO
+	}
+	return caps
+}
+
+// GSOMaxSize returns the largest buffer the stack may hand WriteNotify,
+// matching netutil.GROMaxCoalesced so an oversized write never exceeds what
+// SegmentTCP and the GRO path are sized to handle.
+func (e *Endpoint) GSOMaxSize() uint32 {
+	return netutil.GROMaxCoalesced
+}
+
+// Options configures the optional offload behavior NewEndpointWithOffload
+// enables on top of the plain NewEndpoint path.
+type Options struct {
+	// TSOEnabled splits outbound TCP writes larger than mtu into MSS-sized
+	// segments before handing them to the device.
+	TSOEnabled bool
+	// GROEnabled coalesces contiguous inbound TCP segments into a single
+	// packet before injecting them into the stack.
+	GROEnabled bool
+}
+
+// NewEndpointWithOffload is like NewEndpoint but additionally enables TCP
+// segmentation offload and/or generic receive offload as described by opts.
+func NewEndpointWithOffload(dev Device, mtu int, opts Options) stack.LinkEndpoint {
+	ep := NewEndpoint(dev, mtu).(*Endpoint)
+	ep.tso = opts.TSOEnabled
+	if opts.GROEnabled {
+		ep.gro = netutil.NewGROTable(func(buf []byte) {
+			injectInbound(ep.Endpoint, buf)
+		})
+	}
+	return ep
 }
 
 // NewEndpoint is ...
@@ -28,8 +192,23 @@ func NewEndpoint(dev Device, mtu int) stack.LinkEndpoint {
 		dev:      dev,
 		mtu:      mtu,
 		buf:      make([]byte, 4+mtu),
-		wt:       dev.(WriterOffset),
+		io:       unixPacketIO{r: dev.(ReaderOffset), w: dev.(WriterOffset)},
+		ingress:  netutil.NewChain(),
+		egress:   netutil.NewChain(),
 	}
+
+	if br, ok := dev.(BatchReader); ok {
+		ep.br = br
+		ep.rbufs = make([][]byte, BatchSize)
+		ep.rsize = make([]int, BatchSize)
+		for i := range ep.rbufs {
+			ep.rbufs[i] = make([]byte, 4+mtu)
+		}
+	}
+	if bw, ok := dev.(BatchWriter); ok {
+		ep.bw = bw
+	}
+
 	ep.Endpoint.AddNotify(ep)
 	return ep
 }
@@ -38,42 +217,194 @@ func NewEndpoint(dev Device, mtu int) stack.LinkEndpoint {
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 	e.Endpoint.Attach(dispatcher)
 
-	go func(r ReaderOffset, size int, ep *channel.Endpoint) {
+	if e.br != nil {
+		go e.readBatchLoop()
+		return
+	}
+
+	go func(io PacketIO, headroom int) {
 		for {
-			buf := make([]byte, size)
-			n, err := r.ReadOffset(buf, 4)
+			buf := e.getBuf()
+			n, offset, err := io.ReadPacket(buf, headroom)
 			if err != nil {
+				e.putBuf(buf)
 				break
 			}
-			buf = buf[4 : 4+n]
-
-			switch header.IPVersion(buf) {
-			case header.IPv4Version:
-				ep.InjectInbound(header.IPv4ProtocolNumber, &stack.PacketBuffer{
-					Data: buffer.View(buf).ToVectorisedView(),
-				})
-			case header.IPv6Version:
-				ep.InjectInbound(header.IPv6ProtocolNumber, &stack.PacketBuffer{
-					Data: buffer.View(buf).ToVectorisedView(),
-				})
-			}
+			e.inject(buf[offset:offset+n], func() { e.putBuf(buf) })
+		}
+	}(e.io, unixHeadroom)
+}
+
+// readBatchLoop drains the device's BatchReader and injects every packet it
+// returns, falling back to nothing special on error: the loop simply stops,
+// matching the single-packet path.
+func (e *Endpoint) readBatchLoop() {
+	for {
+		n, err := e.br.ReadBatch(e.rbufs, e.rsize)
+		if err != nil {
+			break
+		}
+		for i := 0; i < n; i++ {
+			e.inject(e.rbufs[i][4:4+e.rsize[i]], nil)
+		}
+	}
+}
+
+// inject routes an inbound packet through the GRO table when offload is
+// enabled, otherwise injecting it into the stack directly. release, if not
+// nil, is called once buf is no longer needed so its backing array (a pool
+// buffer acquired by the caller, or a slot in the BatchReader's rbufs ring)
+// can be reused.
+//
+// buf must not be retained past this call: the old-style
+// &stack.PacketBuffer{} injectInbound builds below has no refcounting or
+// release hook, unlike the gVisor API the windows backend targets, so there
+// is no safe point at which we could be told the stack is done with it. Any
+// packet actually handed to the stack is therefore copied first; buf itself
+// is released (if release is non-nil) right after that copy, not after
+// InjectInbound returns, since the stack may keep the packet queued well
+// past that call.
+func (e *Endpoint) inject(buf []byte, release func()) {
+	atomic.AddUint64(&e.stats.PacketsIn, 1)
+	if e.tap != nil {
+		e.tap.Publish(netutil.DirIngress, buf)
+	}
+	switch e.ingress.Run(buf) {
+	case netutil.Drop:
+		atomic.AddUint64(&e.stats.Drops, 1)
+		if release != nil {
+			release()
+		}
+		return
+	case netutil.Queue:
+		if release != nil {
+			release()
+		}
+		return
+	}
+	if e.gro != nil && e.gro.Enqueue(buf) {
+		if release != nil {
+			release()
 		}
-	}(e.dev.(ReaderOffset), 4+e.mtu, e.Endpoint)
+		return
+	}
+	owned := append([]byte(nil), buf...)
+	if release != nil {
+		release()
+	}
+	injectInbound(e.Endpoint, owned)
+}
+
+// injectInbound hands a single packet read from the device to the stack.
+func injectInbound(ep *channel.Endpoint, buf []byte) {
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ep.InjectInbound(header.IPv4ProtocolNumber, &stack.PacketBuffer{
+			Data: buffer.View(buf).ToVectorisedView(),
+		})
+	case header.IPv6Version:
+		ep.InjectInbound(header.IPv6ProtocolNumber, &stack.PacketBuffer{
+			Data: buffer.View(buf).ToVectorisedView(),
+		})
+	}
 }
 
 // WriteNotify is to write packets back to system
 func (e *Endpoint) WriteNotify() {
+	if e.bw == nil {
+		e.writeOne()
+		return
+	}
+	e.writeBatch()
+}
+
+// writeOne flushes a single packet through WriterOffset, the original path.
+func (e *Endpoint) writeOne() {
 	info, ok := e.Endpoint.Read()
 	if !ok {
 		return
 	}
 
 	e.mu.Lock()
+	defer e.mu.Unlock()
 	buf := append(e.buf[:4], info.Pkt.NetworkHeader().View()...)
 	buf = append(buf, info.Pkt.TransportHeader().View()...)
 	buf = append(buf, info.Pkt.Data.ToView()...)
-	e.wt.WriteOffset(buf, 4)
-	e.mu.Unlock()
+
+	switch e.egress.Run(buf[4:]) {
+	case netutil.Drop, netutil.Queue:
+		atomic.AddUint64(&e.stats.Drops, 1)
+		return
+	}
+	if e.tap != nil {
+		e.tap.Publish(netutil.DirEgress, buf[4:])
+	}
+
+	if !e.tso {
+		e.io.WritePacket(buf, 4)
+		atomic.AddUint64(&e.stats.PacketsOut, 1)
+		return
+	}
+	for _, seg := range netutil.SegmentTCP(buf[4:], e.mtu) {
+		out := append(make([]byte, 4, 4+len(seg)), seg...)
+		e.io.WritePacket(out, 4)
+		atomic.AddUint64(&e.stats.PacketsOut, 1)
+	}
+}
+
+// writeBatch drains up to BatchSize queued packets and flushes them through
+// the device's BatchWriter in a single call, drawing each packet's backing
+// array from bufPool like writeOne's single-packet path instead of
+// allocating one per packet; the pooled buffers are returned once
+// WriteBatch has consumed them.
+func (e *Endpoint) writeBatch() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	bufs := make([][]byte, 0, BatchSize)
+	var pooled [][]byte
+	defer func() {
+		for _, b := range pooled {
+			e.putBuf(b)
+		}
+	}()
+
+	info, ok := e.Endpoint.Read()
+	for ok {
+		raw := e.getBuf()
+		pooled = append(pooled, raw)
+		buf := append(raw[:4:cap(raw)], info.Pkt.NetworkHeader().View()...)
+		buf = append(buf, info.Pkt.TransportHeader().View()...)
+		buf = append(buf, info.Pkt.Data.ToView()...)
+
+		switch e.egress.Run(buf[4:]) {
+		case netutil.Drop, netutil.Queue:
+			atomic.AddUint64(&e.stats.Drops, 1)
+			info, ok = e.Endpoint.Read()
+			continue
+		}
+		if e.tap != nil {
+			e.tap.Publish(netutil.DirEgress, buf[4:])
+		}
+
+		if e.tso {
+			for _, seg := range netutil.SegmentTCP(buf[4:], e.mtu) {
+				out := append(make([]byte, 4, 4+len(seg)), seg...)
+				bufs = append(bufs, out)
+			}
+		} else {
+			bufs = append(bufs, buf)
+		}
+		if len(bufs) >= BatchSize {
+			break
+		}
+		info, ok = e.Endpoint.Read()
+	}
+	if len(bufs) == 0 {
+		return
+	}
+	atomic.AddUint64(&e.stats.PacketsOut, uint64(len(bufs)))
+	e.bw.WriteBatch(bufs)
 }
 
 // ReaderOffset is for unix tun reading with 4 bytes prefix
@@ -0,0 +1,44 @@
+// +build linux darwin
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/eyasliu/shadow/netstack/netutil"
+)
+
+// Tap returns the Endpoint's packet tap, creating it on first use.
+func (e *Endpoint) Tap() *netutil.Tap {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.tap == nil {
+		e.tap = netutil.NewTap()
+	}
+	return e.tap
+}
+
+// Inject safely feeds a raw IPv4/IPv6 frame into the endpoint as though it
+// had crossed the link in direction dir: DirIngress is equivalent to a
+// packet read from the device, DirEgress to one written back to it. buf's
+// checksums are recomputed first, since callers typically hand in packets
+// assembled or edited by hand.
+func (e *Endpoint) Inject(dir netutil.Direction, buf []byte) error {
+	netutil.RecomputeChecksums(buf)
+
+	switch dir {
+	case netutil.DirIngress:
+		e.inject(buf, nil)
+		return nil
+	case netutil.DirEgress:
+		out := append(make([]byte, 4, 4+len(buf)), buf...)
+		if e.bw != nil {
+			_, err := e.bw.WriteBatch([][]byte{out})
+			return err
+		}
+		_, err := e.io.WritePacket(out, 4)
+		return err
+	default:
+		return fmt.Errorf("core: unknown tap direction %d", dir)
+	}
+}
@@ -0,0 +1,186 @@
+// Package netutil holds the packet-hook, offload and tap logic shared by
+// shadow's unix and windows netstack/core Endpoint implementations. The two
+// platforms wrap genuinely different gVisor backends (unix targets the
+// classic channel.Endpoint/buffer.View API, windows a newer
+// PacketBuffer/buffer.Buffer one) so their Endpoints stay separate, but
+// everything in this package operates on raw packet bytes and is identical
+// on both sides.
+package netutil
+
+import (
+	"net"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Verdict is the outcome a PacketHook returns for a packet it inspected.
+type Verdict int
+
+const (
+	// Accept lets the packet continue down the path unchanged.
+	Accept Verdict = iota
+	// Drop discards the packet silently.
+	Drop
+	// Mutate lets the packet continue; the hook has edited HookPacket.Buf
+	// in place.
+	Mutate
+	// Queue takes the packet off the normal ingress/egress path. The
+	// Endpoint discards it and hands it nowhere else, so a hook that keeps
+	// the packet must copy HookPacket.Buf before returning.
+	Queue
+)
+
+// HookPacket is the parsed view of a packet handed to a PacketHook. Buf is
+// the raw packet including IP header; editing it in place and returning
+// Mutate carries the edit forward.
+type HookPacket struct {
+	Buf      []byte
+	IPv6     bool
+	SrcAddr  tcpip.Address
+	DstAddr  tcpip.Address
+	Proto    tcpip.TransportProtocolNumber
+	SrcPort  uint16
+	DstPort  uint16
+	TCPFlags header.TCPFlags
+}
+
+// PacketHook inspects a parsed packet and returns a verdict.
+type PacketHook func(pkt *HookPacket) Verdict
+
+// Chain is an ordered list of PacketHooks run until one returns a verdict
+// other than Accept, mirroring gVisor's netfilter hook chains.
+type Chain struct {
+	mu    sync.RWMutex
+	hooks []PacketHook
+}
+
+// NewChain is ...
+func NewChain() *Chain {
+	return &Chain{}
+}
+
+// Use appends a hook to the end of the chain.
+func (c *Chain) Use(h PacketHook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, h)
+}
+
+// Run parses buf and executes the chain against it, returning Accept when
+// the chain is empty or buf is not a recognised IPv4/IPv6 packet.
+func (c *Chain) Run(buf []byte) Verdict {
+	c.mu.RLock()
+	hooks := c.hooks
+	c.mu.RUnlock()
+	if len(hooks) == 0 {
+		return Accept
+	}
+
+	pkt, ok := parseHookPacket(buf)
+	if !ok {
+		return Accept
+	}
+	for _, h := range hooks {
+		if v := h(pkt); v != Accept {
+			return v
+		}
+	}
+	return Accept
+}
+
+// parseHookPacket extracts the 5-tuple and TCP flags (when present) from an
+// IPv4/IPv6 packet so matchers don't each re-parse the header.
+func parseHookPacket(buf []byte) (*HookPacket, bool) {
+	pkt := &HookPacket{Buf: buf}
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ip := header.IPv4(buf)
+		pkt.SrcAddr = ip.SourceAddress()
+		pkt.DstAddr = ip.DestinationAddress()
+		pkt.Proto = ip.TransportProtocol()
+		parseTransportPorts(pkt, ip.Payload())
+	case header.IPv6Version:
+		ip := header.IPv6(buf)
+		pkt.IPv6 = true
+		pkt.SrcAddr = ip.SourceAddress()
+		pkt.DstAddr = ip.DestinationAddress()
+		pkt.Proto = ip.TransportProtocol()
+		parseTransportPorts(pkt, ip.Payload())
+	default:
+		return nil, false
+	}
+	return pkt, true
+}
+
+// parseTransportPorts fills in the source/dest ports and TCP flags (when
+// applicable) of the transport payload following the IP header.
+func parseTransportPorts(pkt *HookPacket, payload []byte) {
+	switch pkt.Proto {
+	case header.TCPProtocolNumber:
+		if len(payload) < header.TCPMinimumSize {
+			return
+		}
+		tcp := header.TCP(payload)
+		pkt.SrcPort = tcp.SourcePort()
+		pkt.DstPort = tcp.DestinationPort()
+		pkt.TCPFlags = tcp.Flags()
+	case header.UDPProtocolNumber:
+		if len(payload) < header.UDPMinimumSize {
+			return
+		}
+		udp := header.UDP(payload)
+		pkt.SrcPort = udp.SourcePort()
+		pkt.DstPort = udp.DestinationPort()
+	}
+}
+
+// Matcher tests a HookPacket and reports whether it matches.
+type Matcher func(pkt *HookPacket) bool
+
+// MatchSrcCIDR matches packets whose source address falls inside n.
+func MatchSrcCIDR(n *net.IPNet) Matcher {
+	return func(pkt *HookPacket) bool { return n.Contains(net.IP(pkt.SrcAddr.AsSlice())) }
+}
+
+// MatchDstCIDR matches packets whose destination address falls inside n.
+func MatchDstCIDR(n *net.IPNet) Matcher {
+	return func(pkt *HookPacket) bool { return n.Contains(net.IP(pkt.DstAddr.AsSlice())) }
+}
+
+// MatchProto matches packets carrying the given transport protocol.
+func MatchProto(proto tcpip.TransportProtocolNumber) Matcher {
+	return func(pkt *HookPacket) bool { return pkt.Proto == proto }
+}
+
+// MatchDstPortRange matches packets whose destination port falls in
+// [lo, hi].
+func MatchDstPortRange(lo, hi uint16) Matcher {
+	return func(pkt *HookPacket) bool { return pkt.DstPort >= lo && pkt.DstPort <= hi }
+}
+
+// MatchSrcPortRange matches packets whose source port falls in [lo, hi].
+func MatchSrcPortRange(lo, hi uint16) Matcher {
+	return func(pkt *HookPacket) bool { return pkt.SrcPort >= lo && pkt.SrcPort <= hi }
+}
+
+// MatchTCPFlags matches TCP packets whose flags, masked by mask, equal want.
+func MatchTCPFlags(mask, want header.TCPFlags) Matcher {
+	return func(pkt *HookPacket) bool {
+		return pkt.Proto == header.TCPProtocolNumber && pkt.TCPFlags&mask == want
+	}
+}
+
+// NewHook ANDs matchers together into a single PacketHook that returns
+// verdict when every matcher matches, and Accept otherwise.
+func NewHook(verdict Verdict, matchers ...Matcher) PacketHook {
+	return func(pkt *HookPacket) Verdict {
+		for _, m := range matchers {
+			if !m(pkt) {
+				return Accept
+			}
+		}
+		return verdict
+	}
+}
@@ -0,0 +1,95 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestChainRunEmptyAcceptsEverything(t *testing.T) {
+	c := NewChain()
+	buf := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1, 1, header.TCPFlagSyn, 65535, nil, nil)
+	if v := c.Run(buf); v != Accept {
+		t.Fatalf("Run on empty chain = %v, want Accept", v)
+	}
+}
+
+func TestChainRunStopsAtFirstNonAccept(t *testing.T) {
+	var ran []int
+	c := NewChain()
+	c.Use(func(pkt *HookPacket) Verdict {
+		ran = append(ran, 1)
+		return Accept
+	})
+	c.Use(func(pkt *HookPacket) Verdict {
+		ran = append(ran, 2)
+		return Drop
+	})
+	c.Use(func(pkt *HookPacket) Verdict {
+		ran = append(ran, 3)
+		return Accept
+	})
+
+	buf := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1, 1, header.TCPFlagSyn, 65535, nil, nil)
+	if v := c.Run(buf); v != Drop {
+		t.Fatalf("Run = %v, want Drop", v)
+	}
+	if len(ran) != 2 {
+		t.Fatalf("hooks ran = %v, want the chain to stop after the Drop verdict", ran)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	buf := buildTCPv4(t, "10.0.0.1", "192.168.1.5", 1234, 443, 1, 1, header.TCPFlagSyn, 65535, nil, nil)
+	pkt, ok := parseHookPacket(buf)
+	if !ok {
+		t.Fatalf("parseHookPacket failed")
+	}
+
+	_, srcNet, _ := net.ParseCIDR("10.0.0.0/24")
+	_, otherNet, _ := net.ParseCIDR("172.16.0.0/24")
+	_, dstNet, _ := net.ParseCIDR("192.168.1.0/24")
+
+	tests := []struct {
+		name string
+		m    Matcher
+		want bool
+	}{
+		{"src CIDR match", MatchSrcCIDR(srcNet), true},
+		{"src CIDR no match", MatchSrcCIDR(otherNet), false},
+		{"dst CIDR match", MatchDstCIDR(dstNet), true},
+		{"proto match", MatchProto(header.TCPProtocolNumber), true},
+		{"proto no match", MatchProto(header.UDPProtocolNumber), false},
+		{"dst port in range", MatchDstPortRange(443, 443), true},
+		{"dst port out of range", MatchDstPortRange(80, 80), false},
+		{"src port in range", MatchSrcPortRange(1000, 2000), true},
+		{"tcp flags match", MatchTCPFlags(header.TCPFlagSyn|header.TCPFlagAck, header.TCPFlagSyn), true},
+		{"tcp flags no match", MatchTCPFlags(header.TCPFlagSyn|header.TCPFlagAck, header.TCPFlagSyn|header.TCPFlagAck), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m(pkt); got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHookRequiresAllMatchers(t *testing.T) {
+	buf := buildTCPv4(t, "10.0.0.1", "192.168.1.5", 1234, 443, 1, 1, header.TCPFlagSyn, 65535, nil, nil)
+	pkt, ok := parseHookPacket(buf)
+	if !ok {
+		t.Fatalf("parseHookPacket failed")
+	}
+
+	always := func(*HookPacket) bool { return true }
+	never := func(*HookPacket) bool { return false }
+
+	if v := NewHook(Drop, always, always)(pkt); v != Drop {
+		t.Errorf("NewHook with all-matching matchers = %v, want Drop", v)
+	}
+	if v := NewHook(Drop, always, never)(pkt); v != Accept {
+		t.Errorf("NewHook with one non-matching matcher = %v, want Accept", v)
+	}
+}
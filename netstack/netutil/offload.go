@@ -0,0 +1,383 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// groFlushInterval bounds how long a coalesced segment may sit buffered
+// before being flushed even if no further in-order data arrives.
+const groFlushInterval = 50 * time.Microsecond
+
+// groTableSize caps the number of in-flight flows GROTable tracks; once full,
+// the oldest entry is flushed to make room rather than growing unbounded.
+const groTableSize = 64
+
+// groKey identifies a TCP flow plus the IP ID base it is being coalesced
+// under, following the virtio-net GSO/GRO approach used by WireGuard-Go's
+// Linux tun.
+type groKey struct {
+	srcAddr, dstAddr string
+	srcPort, dstPort uint16
+	ipID             uint16
+	v6               bool
+}
+
+// groEntry is one in-flight coalesced segment for a flow.
+type groEntry struct {
+	buf      []byte
+	ipHdrLen int
+	nextSeq  uint32
+	timer    *time.Timer
+}
+
+// GROTable coalesces contiguous same-flow TCP segments read from the TUN
+// into one larger buffer before it is injected into the stack, so the stack
+// processes one big segment instead of many small ones. Entries are mutated
+// both by the reader goroutine that calls Enqueue and by the per-flow timer
+// goroutine that calls flushEntry on expiry, so all access to
+// entries/order is guarded by mu.
+type GROTable struct {
+	mu      sync.Mutex
+	entries map[groKey]*groEntry
+	order   []groKey
+	flush   func(buf []byte)
+}
+
+// NewGROTable is ...
+func NewGROTable(flush func(buf []byte)) *GROTable {
+	return &GROTable{
+		entries: make(map[groKey]*groEntry, groTableSize),
+		flush:   flush,
+	}
+}
+
+// Enqueue tries to coalesce buf into an existing flow entry. It returns true
+// if buf was absorbed and the caller should not inject it on its own; it
+// returns false when buf is not eligible for coalescing (not TCP, flags
+// beyond ACK, or a sequence gap) and the caller must inject buf itself after
+// flushing whatever was already buffered for that flow.
+func (t *GROTable) Enqueue(buf []byte) bool {
+	key, ipHdrLen, seq, payload, ok := groParse(buf)
+	if !ok {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, found := t.entries[key]; found {
+		if seq == e.nextSeq && len(e.buf)+len(payload) <= GROMaxCoalesced {
+			groAppend(e, header.TCP(buf[ipHdrLen:]), payload)
+			if len(e.buf) >= groMSSFlushThreshold {
+				t.flushEntryLocked(key)
+			}
+			return true
+		}
+		// Sequence gap or size limit hit: flush what we have, then let the
+		// caller inject buf as-is.
+		t.flushEntryLocked(key)
+		return false
+	}
+
+	if len(t.order) >= groTableSize {
+		t.flushEntryLocked(t.order[0])
+	}
+	t.newEntry(key, ipHdrLen, seq, buf)
+	return true
+}
+
+// newEntry starts coalescing a fresh flow, arming the flush timer. Callers
+// must hold t.mu.
+func (t *GROTable) newEntry(key groKey, ipHdrLen int, seq uint32, buf []byte) {
+	e := &groEntry{
+		buf:      append([]byte(nil), buf...),
+		ipHdrLen: ipHdrLen,
+		nextSeq:  seq + uint32(len(buf)-headerLen(buf, ipHdrLen)),
+	}
+	e.timer = time.AfterFunc(groFlushInterval, func() { t.flushEntry(key) })
+	t.entries[key] = e
+	t.order = append(t.order, key)
+}
+
+// groAppend merges payload into the coalesced buffer and fixes up the IP
+// total length and TCP checksum incrementally per RFC 1624, rather than
+// recomputing the checksum over the whole (growing) buffer each time. It
+// also folds newTCP's Ack number, window and timestamp echo-reply into the
+// buffered header, so the segment GRO eventually flushes reflects the
+// latest flow-control state of the run it coalesced rather than the first
+// packet's stale values. The TCP pseudo-header's length field grows along
+// with the buffer, so that delta is folded in too alongside the other
+// field replacements.
+func groAppend(e *groEntry, newTCP header.TCP, payload []byte) {
+	oldTCPLen := len(e.buf) - e.ipHdrLen
+	e.buf = append(e.buf, payload...)
+	e.nextSeq += uint32(len(payload))
+	newTCPLen := len(e.buf) - e.ipHdrLen
+
+	if header.IPVersion(e.buf) == header.IPv4Version {
+		ip := header.IPv4(e.buf)
+		ip.SetTotalLength(uint16(len(e.buf)))
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+	} else {
+		ip := header.IPv6(e.buf)
+		ip.SetPayloadLength(uint16(len(e.buf) - header.IPv6MinimumSize))
+	}
+
+	tcp := header.TCP(e.buf[e.ipHdrLen:])
+	added := payload
+	if oldTCPLen%2 == 1 {
+		// payload starts at an odd offset, so its first byte is the low
+		// byte of the 16-bit word the previous last byte began.
+		added = append([]byte{0}, payload...)
+	}
+	sum := incrementalChecksumAdd(^tcp.Checksum(), added)
+
+	sum = replaceChecksumField16(sum, uint16(oldTCPLen), uint16(newTCPLen))
+
+	sum = replaceChecksumField32(sum, tcp.AckNumber(), newTCP.AckNumber())
+	binary.BigEndian.PutUint32(tcp[8:12], newTCP.AckNumber())
+
+	sum = replaceChecksumField16(sum, tcp.WindowSize(), newTCP.WindowSize())
+	binary.BigEndian.PutUint16(tcp[14:16], newTCP.WindowSize())
+
+	if off, oldEcr, ok := tcpTimestampTSecr(tcp); ok {
+		if _, newEcr, ok2 := tcpTimestampTSecr(newTCP); ok2 {
+			sum = replaceChecksumField32(sum, oldEcr, newEcr)
+			binary.BigEndian.PutUint32(tcp[off:], newEcr)
+		}
+	}
+
+	tcp.SetChecksum(0)
+	tcp.SetChecksum(^sum)
+}
+
+// flushEntry hands the coalesced buffer for key to the stack and forgets
+// the flow, called on flag changes, MSS overflow, timer expiry, or
+// eviction. It is safe to call from any goroutine, including the timer
+// callback armed in newEntry.
+func (t *GROTable) flushEntry(key groKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flushEntryLocked(key)
+}
+
+// flushEntryLocked is flushEntry's body; callers must hold t.mu.
+func (t *GROTable) flushEntryLocked(key groKey) {
+	e, ok := t.entries[key]
+	if !ok {
+		return
+	}
+	e.timer.Stop()
+	delete(t.entries, key)
+	for i, k := range t.order {
+		if k == key {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	t.flush(e.buf)
+}
+
+// GROMaxCoalesced is the largest buffer GROTable will build before flushing,
+// sized for a single large PacketBuffer the stack can digest in one pass.
+const GROMaxCoalesced = 1 << 16
+
+// groMSSFlushThreshold flushes a coalesced segment once it has accumulated
+// enough bytes that holding it longer stops paying off.
+const groMSSFlushThreshold = 48 * 1024
+
+// groParse extracts the flow key, IP header length, TCP sequence number and
+// payload from buf if it is a pure-ACK IPv4/IPv6 TCP segment eligible for
+// coalescing; ok is false for anything else (SYN/FIN/RST, options mismatch,
+// or non-TCP).
+func groParse(buf []byte) (key groKey, ipHdrLen int, seq uint32, payload []byte, ok bool) {
+	ipHdrLen, seq, payload, ok = parseTCPSegment(buf)
+	if !ok {
+		return key, 0, 0, nil, false
+	}
+	tcp := header.TCP(buf[ipHdrLen:])
+	if tcp.Flags() != header.TCPFlagAck {
+		return key, 0, 0, nil, false
+	}
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ip := header.IPv4(buf)
+		key = groKey{
+			srcAddr: string(ip.SourceAddress()),
+			dstAddr: string(ip.DestinationAddress()),
+			srcPort: tcp.SourcePort(),
+			dstPort: tcp.DestinationPort(),
+			ipID:    ip.ID(),
+		}
+	case header.IPv6Version:
+		ip := header.IPv6(buf)
+		key = groKey{
+			srcAddr: string(ip.SourceAddress()),
+			dstAddr: string(ip.DestinationAddress()),
+			srcPort: tcp.SourcePort(),
+			dstPort: tcp.DestinationPort(),
+			v6:      true,
+		}
+	}
+	return key, ipHdrLen, seq, payload, true
+}
+
+// parseTCPSegment extracts the IP header length, TCP sequence number and
+// payload of an IPv4/IPv6 TCP segment, regardless of its flags; ok is false
+// for anything else (fragmented IPv4, or non-TCP).
+func parseTCPSegment(buf []byte) (ipHdrLen int, seq uint32, payload []byte, ok bool) {
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ip := header.IPv4(buf)
+		if ip.TransportProtocol() != header.TCPProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return 0, 0, nil, false
+		}
+		ipHdrLen = int(ip.HeaderLength())
+	case header.IPv6Version:
+		if header.IPv6(buf).TransportProtocol() != header.TCPProtocolNumber {
+			return 0, 0, nil, false
+		}
+		ipHdrLen = header.IPv6MinimumSize
+	default:
+		return 0, 0, nil, false
+	}
+	tcp := header.TCP(buf[ipHdrLen:])
+	return ipHdrLen, tcp.SequenceNumber(), tcp.Payload(), true
+}
+
+// headerLen returns the combined IP+TCP header length so callers can derive
+// the payload length of a freshly buffered segment.
+func headerLen(buf []byte, ipHdrLen int) int {
+	tcp := header.TCP(buf[ipHdrLen:])
+	return ipHdrLen + int(tcp.DataOffset())
+}
+
+// incrementalChecksumAdd folds payload into an existing ones-complement sum
+// per RFC 1624, avoiding a full recompute over the coalesced buffer.
+func incrementalChecksumAdd(sum uint16, payload []byte) uint16 {
+	acc := uint32(sum)
+	for i := 0; i+1 < len(payload); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(payload[i : i+2]))
+	}
+	if len(payload)%2 == 1 {
+		acc += uint32(payload[len(payload)-1]) << 8
+	}
+	for acc > 0xffff {
+		acc = (acc & 0xffff) + (acc >> 16)
+	}
+	return uint16(acc)
+}
+
+// replaceChecksumField16 folds a 16-bit header field changing from old to
+// new into an existing ones-complement sum, per RFC 1624's "replace a
+// field" formula HC' = ~(~HC + ~m + m'), avoiding a full recompute.
+func replaceChecksumField16(sum, old, new_ uint16) uint16 {
+	acc := uint32(sum) + uint32(^old) + uint32(new_)
+	for acc > 0xffff {
+		acc = (acc & 0xffff) + (acc >> 16)
+	}
+	return uint16(acc)
+}
+
+// replaceChecksumField32 is replaceChecksumField16 applied to each 16-bit
+// half of a 32-bit field.
+func replaceChecksumField32(sum uint16, old, new_ uint32) uint16 {
+	sum = replaceChecksumField16(sum, uint16(old>>16), uint16(new_>>16))
+	return replaceChecksumField16(sum, uint16(old), uint16(new_))
+}
+
+// tcpTimestampTSecr locates the TSecr field of tcp's Timestamps option, if
+// present, returning its byte offset within tcp and its current value.
+func tcpTimestampTSecr(tcp header.TCP) (off int, tsecr uint32, ok bool) {
+	opts := tcp.Options()
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case header.TCPOptionEOL:
+			return 0, 0, false
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return 0, 0, false
+		}
+		length := int(opts[i+1])
+		if length < 2 || i+length > len(opts) {
+			return 0, 0, false
+		}
+		if opts[i] == header.TCPOptionTS && length == header.TCPOptionTSLength {
+			off = int(tcp.DataOffset()) - len(opts) + i + 6
+			return off, binary.BigEndian.Uint32(opts[i+6 : i+10]), true
+		}
+		i += length
+	}
+	return 0, 0, false
+}
+
+// SegmentTCP splits a single outbound TCP buffer larger than the link mtu
+// into MSS-sized segments, cloning the IP/TCP headers and adjusting the
+// sequence number, IP total length and checksums on each piece. It mirrors
+// the TSO offload a real NIC would perform, since the TUN device has none.
+// PSH/FIN flags from the original segment are only kept on the last piece.
+func SegmentTCP(buf []byte, mtu int) [][]byte {
+	if len(buf) <= mtu {
+		return [][]byte{buf}
+	}
+	if header.IPVersion(buf) != header.IPv4Version && header.IPVersion(buf) != header.IPv6Version {
+		return [][]byte{buf}
+	}
+
+	ipHdrLen, seq, payload, ok := parseTCPSegment(buf)
+	if !ok {
+		return [][]byte{buf}
+	}
+	hdrLen := headerLen(buf, ipHdrLen)
+	mss := mtu - hdrLen
+	if mss <= 0 || len(payload) <= mss {
+		return [][]byte{buf}
+	}
+	origFlags := header.TCP(buf[ipHdrLen:]).Flags()
+	keepFlags := origFlags &^ (header.TCPFlagPsh | header.TCPFlagFin)
+
+	var segs [][]byte
+	for off := 0; off < len(payload); off += mss {
+		end := off + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		seg := append([]byte(nil), buf[:hdrLen]...)
+		seg = append(seg, payload[off:end]...)
+
+		tcp := header.TCP(seg[ipHdrLen:])
+		tcp.SetSequenceNumber(seq + uint32(off))
+		flags := keepFlags
+		if end == len(payload) {
+			flags = origFlags
+		}
+		tcp.SetFlags(uint8(flags))
+
+		if header.IPVersion(seg) == header.IPv4Version {
+			ip := header.IPv4(seg)
+			ip.SetTotalLength(uint16(len(seg)))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+			tcp.SetChecksum(0)
+			sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(seg)-ipHdrLen))
+			tcp.SetChecksum(^tcp.CalculateChecksum(sum))
+		} else {
+			ip := header.IPv6(seg)
+			ip.SetPayloadLength(uint16(len(seg) - header.IPv6MinimumSize))
+			tcp.SetChecksum(0)
+			sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(seg)-ipHdrLen))
+			tcp.SetChecksum(^tcp.CalculateChecksum(sum))
+		}
+
+		segs = append(segs, seg)
+	}
+	return segs
+}
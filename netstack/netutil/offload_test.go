@@ -0,0 +1,161 @@
+package netutil
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// TestGroAppendChecksumMatchesFullRecompute guards against the pseudo-header
+// length field: growing the coalesced buffer changes the TCP segment length
+// the pseudo-header checksum covers, not just the payload bytes, so the
+// expected checksum here is computed by an entirely independent path
+// (header.PseudoHeaderChecksum + checksum.Checksum over the grown buffer)
+// rather than by re-deriving it with incrementalChecksumAdd, which would let
+// a shared bug in both sides cancel out.
+func TestGroAppendChecksumMatchesFullRecompute(t *testing.T) {
+	base := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1000, 1, header.TCPFlagAck, 65535, nil, []byte("hello "))
+	ipHdrLen := header.IPv4MinimumSize
+
+	e := &groEntry{
+		buf:      append([]byte(nil), base...),
+		ipHdrLen: ipHdrLen,
+		nextSeq:  1000 + uint32(len("hello ")),
+	}
+	sameFlowControl := header.TCP(base[ipHdrLen:])
+	groAppend(e, sameFlowControl, []byte("world"))
+
+	tcp := header.TCP(e.buf[ipHdrLen:])
+	ip := header.IPv4(e.buf)
+	wantSum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(ip.Payload())))
+	wantSum = checksum.Checksum(tcp.Payload(), wantSum)
+	want := ^tcp.CalculateChecksum(wantSum)
+	if got := tcp.Checksum(); got != want {
+		t.Fatalf("groAppend checksum = %#x, want %#x (full recompute)", got, want)
+	}
+	if got, want := string(tcp.Payload()), "hello world"; got != want {
+		t.Fatalf("groAppend payload = %q, want %q", got, want)
+	}
+}
+
+func TestReplaceChecksumField(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new uint32
+	}{
+		{"unchanged", 5, 5},
+		{"increase", 5, 9},
+		{"decrease", 9, 5},
+		{"wraps", 0xffff, 0x0001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, 4)
+			putUint32(payload, tt.old)
+			sum := incrementalChecksumAdd(0, payload)
+
+			replaced := replaceChecksumField32(sum, tt.old, tt.new)
+
+			payload2 := make([]byte, 4)
+			putUint32(payload2, tt.new)
+			want := incrementalChecksumAdd(0, payload2)
+
+			if replaced != want {
+				t.Fatalf("replaceChecksumField32(%#x -> %#x) = %#x, want %#x", tt.old, tt.new, replaced, want)
+			}
+		})
+	}
+}
+
+func TestGROTableCoalescesAndUpdatesFlowControlState(t *testing.T) {
+	var flushed []byte
+	table := NewGROTable(func(buf []byte) { flushed = buf })
+
+	p1 := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1000, 1, header.TCPFlagAck, 100, &tcpOpts{tsVal: 1, tsEcr: 500}, []byte("aaaa"))
+	if ok := table.Enqueue(p1); !ok {
+		t.Fatalf("Enqueue(p1) = false, want true (new entry)")
+	}
+
+	p2 := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1004, 2, header.TCPFlagAck, 200, &tcpOpts{tsVal: 2, tsEcr: 600}, []byte("bbbb"))
+	if ok := table.Enqueue(p2); !ok {
+		t.Fatalf("Enqueue(p2) = false, want true (coalesced)")
+	}
+
+	key, ipHdrLen, _, _, ok := groParse(p1)
+	if !ok {
+		t.Fatalf("groParse(p1) failed")
+	}
+	table.flushEntry(key)
+	if flushed == nil {
+		t.Fatalf("flushEntry did not flush")
+	}
+
+	tcp := header.TCP(flushed[ipHdrLen:])
+	if got := tcp.AckNumber(); got != 2 {
+		t.Errorf("coalesced AckNumber = %d, want 2 (from p2)", got)
+	}
+	if got := tcp.WindowSize(); got != 200 {
+		t.Errorf("coalesced WindowSize = %d, want 200 (from p2)", got)
+	}
+	if _, ecr, ok := tcpTimestampTSecr(tcp); !ok || ecr != 600 {
+		t.Errorf("coalesced TSecr = (%d, %v), want (600, true)", ecr, ok)
+	}
+	if want := len("aaaabbbb"); len(tcp.Payload()) != want {
+		t.Errorf("coalesced payload length = %d, want %d", len(tcp.Payload()), want)
+	}
+	ip := header.IPv4(flushed)
+	want := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(ip.Payload())))
+	want = checksum.Checksum(tcp.Payload(), want)
+	if got := ^tcp.CalculateChecksum(want); got != tcp.Checksum() {
+		t.Errorf("coalesced TCP checksum = %#x, want %#x", tcp.Checksum(), got)
+	}
+}
+
+func TestSegmentTCPSplitsAtMSSAndPreservesFlags(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	buf := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1000, 1, header.TCPFlagAck|header.TCPFlagPsh, 65535, nil, payload)
+
+	const mtu = 1500
+	segs := SegmentTCP(buf, mtu)
+	if len(segs) < 2 {
+		t.Fatalf("SegmentTCP produced %d segments, want at least 2", len(segs))
+	}
+
+	ipHdrLen := header.IPv4MinimumSize
+	wantSeq := uint32(1000)
+	var total int
+	for i, seg := range segs {
+		if len(seg) > mtu {
+			t.Errorf("segment %d length %d exceeds mtu %d", i, len(seg), mtu)
+		}
+		tcp := header.TCP(seg[ipHdrLen:])
+		if tcp.SequenceNumber() != wantSeq {
+			t.Errorf("segment %d SequenceNumber = %d, want %d", i, tcp.SequenceNumber(), wantSeq)
+		}
+		wantSeq += uint32(len(tcp.Payload()))
+		total += len(tcp.Payload())
+
+		last := i == len(segs)-1
+		if last && tcp.Flags()&header.TCPFlagPsh == 0 {
+			t.Errorf("last segment lost the PSH flag")
+		}
+		if !last && tcp.Flags()&header.TCPFlagPsh != 0 {
+			t.Errorf("non-last segment %d unexpectedly carries PSH", i)
+		}
+	}
+	if total != len(payload) {
+		t.Errorf("segmented payload totals %d bytes, want %d", total, len(payload))
+	}
+}
+
+func TestSegmentTCPNoopUnderMTU(t *testing.T) {
+	buf := buildTCPv4(t, "10.0.0.1", "10.0.0.2", 1111, 80, 1000, 1, header.TCPFlagAck, 65535, nil, []byte("small"))
+	segs := SegmentTCP(buf, 1500)
+	if len(segs) != 1 || &segs[0][0] != &buf[0] {
+		t.Fatalf("SegmentTCP should return buf unchanged when already under mtu")
+	}
+}
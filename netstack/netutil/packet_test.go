@@ -0,0 +1,78 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// tcpOpts optionally appends a Timestamps option (kind 8, length 10) to a
+// packet built by buildTCPv4, padded to a multiple of 4 bytes with NOPs.
+type tcpOpts struct {
+	tsVal, tsEcr uint32
+}
+
+func (o *tcpOpts) encode() []byte {
+	if o == nil {
+		return nil
+	}
+	b := make([]byte, 12)
+	b[0], b[1] = header.TCPOptionNOP, header.TCPOptionNOP
+	b[2], b[3] = header.TCPOptionTS, header.TCPOptionTSLength
+	putUint32(b[4:8], o.tsVal)
+	putUint32(b[8:12], o.tsEcr)
+	return b
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
+
+// buildTCPv4 assembles a checksummed IPv4/TCP packet for tests, with srcIP
+// and dstIP as dotted-quad strings.
+func buildTCPv4(t *testing.T, srcIP, dstIP string, srcPort, dstPort uint16, seq, ack uint32, flags header.TCPFlags, window uint16, opts *tcpOpts, payload []byte) []byte {
+	t.Helper()
+
+	optBytes := opts.encode()
+	ipHdrLen := header.IPv4MinimumSize
+	tcpHdrLen := header.TCPMinimumSize + len(optBytes)
+	buf := make([]byte, ipHdrLen+tcpHdrLen+len(payload))
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		ID:          1,
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(srcIP).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dstIP).To4()),
+	})
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(buf[ipHdrLen:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: uint8(tcpHdrLen),
+		Flags:      flags,
+		WindowSize: window,
+	})
+	copy(buf[ipHdrLen+header.TCPMinimumSize:], optBytes)
+	copy(buf[ipHdrLen+tcpHdrLen:], payload)
+
+	sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(tcpHdrLen+len(payload)))
+	sum = checksum.Checksum(tcp.Payload(), sum)
+	tcp.SetChecksum(0)
+	tcp.SetChecksum(^tcp.CalculateChecksum(sum))
+
+	return buf
+}
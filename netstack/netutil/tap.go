@@ -0,0 +1,182 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Direction indicates which side of the link a tapped packet crossed.
+type Direction int
+
+const (
+	// DirIngress is a packet read from the system on its way into the stack.
+	DirIngress Direction = iota
+	// DirEgress is a packet from the stack on its way out to the system.
+	DirEgress
+)
+
+// tapRingSize is how many packets a subscriber buffers before the oldest is
+// dropped to make room for new ones, like a small AF_PACKET ring.
+const tapRingSize = 256
+
+// TapPacket is one packet observed crossing the link, handed to every Tap
+// subscriber.
+type TapPacket struct {
+	Dir Direction
+	Buf []byte
+}
+
+// TapSub is a single subscription returned by Tap.Subscribe; read from C()
+// and call Tap.Unsubscribe when done.
+type TapSub struct {
+	ch chan TapPacket
+}
+
+// C returns the channel packets are delivered on.
+func (s *TapSub) C() <-chan TapPacket {
+	return s.ch
+}
+
+// Tap fans out a copy of every packet crossing the link to each subscriber,
+// giving shadow the "observe + inject" capability AF_PACKET provides on
+// Linux.
+type Tap struct {
+	mu   sync.Mutex
+	subs map[*TapSub]struct{}
+}
+
+// NewTap is ...
+func NewTap() *Tap {
+	return &Tap{subs: make(map[*TapSub]struct{})}
+}
+
+// Subscribe registers a new subscriber with its own ring buffer.
+func (t *Tap) Subscribe() *TapSub {
+	s := &TapSub{ch: make(chan TapPacket, tapRingSize)}
+	t.mu.Lock()
+	t.subs[s] = struct{}{}
+	t.mu.Unlock()
+	return s
+}
+
+// Unsubscribe removes s and closes its channel; it is safe to call more than
+// once.
+func (t *Tap) Unsubscribe(s *TapSub) {
+	t.mu.Lock()
+	if _, ok := t.subs[s]; ok {
+		delete(t.subs, s)
+		close(s.ch)
+	}
+	t.mu.Unlock()
+}
+
+// Publish hands a copy of buf to every subscriber, dropping the oldest
+// buffered packet on a subscriber whose ring is full rather than blocking
+// the link.
+func (t *Tap) Publish(dir Direction, buf []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subs) == 0 {
+		return
+	}
+	for s := range t.subs {
+		cp := append([]byte(nil), buf...)
+		select {
+		case s.ch <- TapPacket{Dir: dir, Buf: cp}:
+		default:
+			select {
+			case <-s.ch:
+			default:
+			}
+			select {
+			case s.ch <- TapPacket{Dir: dir, Buf: cp}:
+			default:
+			}
+		}
+	}
+}
+
+// RecomputeChecksums recomputes the IP and TCP/UDP checksums of an
+// IPv4/IPv6 packet in place, for any backend that delivers packets without
+// correct L4 checksums, e.g. WinDivert.
+func RecomputeChecksums(buf []byte) {
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ip := header.IPv4(buf)
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+		fixTransportChecksum(ip.TransportProtocol(), ip.Payload(), header.PseudoHeaderChecksum(ip.TransportProtocol(), ip.SourceAddress(), ip.DestinationAddress(), uint16(len(ip.Payload()))))
+	case header.IPv6Version:
+		ip := header.IPv6(buf)
+		fixTransportChecksum(ip.TransportProtocol(), ip.Payload(), header.PseudoHeaderChecksum(ip.TransportProtocol(), ip.SourceAddress(), ip.DestinationAddress(), uint16(len(ip.Payload()))))
+	}
+}
+
+// fixTransportChecksum recomputes the UDP or TCP checksum of payload given
+// the pseudo-header sum already covering the IP addresses and length.
+func fixTransportChecksum(proto tcpip.TransportProtocolNumber, payload []byte, pseudoSum uint16) {
+	switch proto {
+	case header.UDPProtocolNumber:
+		hdr := header.UDP(payload)
+		sum := checksum.Checksum(hdr.Payload(), pseudoSum)
+		hdr.SetChecksum(0)
+		hdr.SetChecksum(^hdr.CalculateChecksum(sum))
+	case header.TCPProtocolNumber:
+		hdr := header.TCP(payload)
+		sum := checksum.Checksum(hdr.Payload(), pseudoSum)
+		hdr.SetChecksum(0)
+		hdr.SetChecksum(^hdr.CalculateChecksum(sum))
+	}
+}
+
+// PcapWriter dumps packets observed on a Tap to w in pcap format, so users
+// can capture live traffic to a file for debugging without patching shadow.
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes the pcap global header to w and returns a writer
+// ready to accept packet records.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // magic
+	binary.LittleEndian.PutUint16(hdr[4:], 2)          // version major
+	binary.LittleEndian.PutUint16(hdr[6:], 4)          // version minor
+	binary.LittleEndian.PutUint32(hdr[16:], 1<<16)     // snaplen
+	binary.LittleEndian.PutUint32(hdr[20:], 101)       // LINKTYPE_RAW
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket appends one packet record.
+func (p *PcapWriter) WritePacket(buf []byte) error {
+	now := time.Now()
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(buf)))
+	if _, err := p.w.Write(rec[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(buf)
+	return err
+}
+
+// Dump drains sub until its Tap unsubscribes it, writing every packet to p.
+func (p *PcapWriter) Dump(sub *TapSub) error {
+	for pkt := range sub.C() {
+		if err := p.WritePacket(pkt.Buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package netutil
+
+import "testing"
+
+func TestTapPublishDropsOldestWhenRingFull(t *testing.T) {
+	tap := NewTap()
+	sub := tap.Subscribe()
+	defer tap.Unsubscribe(sub)
+
+	for i := 0; i < tapRingSize+10; i++ {
+		tap.Publish(DirIngress, []byte{byte(i)})
+	}
+
+	if got := len(sub.C()); got != tapRingSize {
+		t.Fatalf("subscriber ring holds %d packets, want %d (full)", got, tapRingSize)
+	}
+
+	first := <-sub.C()
+	if want := byte(10); first.Buf[0] != want {
+		t.Errorf("oldest surviving packet = %d, want %d (the first 10 should have been dropped)", first.Buf[0], want)
+	}
+}
+
+func TestTapPublishCopiesBuf(t *testing.T) {
+	tap := NewTap()
+	sub := tap.Subscribe()
+	defer tap.Unsubscribe(sub)
+
+	buf := []byte{1, 2, 3}
+	tap.Publish(DirIngress, buf)
+	buf[0] = 0xff
+
+	got := <-sub.C()
+	if got.Buf[0] != 1 {
+		t.Errorf("subscriber saw mutation of the caller's buffer: got %v, want first byte 1", got.Buf)
+	}
+}
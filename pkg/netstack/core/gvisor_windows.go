@@ -7,13 +7,14 @@ import (
 	"io"
 	"log"
 	"sync"
-	"unsafe"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/buffer"
-	"gvisor.dev/gvisor/pkg/tcpip/checksum"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/eyasliu/shadow/netstack/netutil"
 )
 
 // Device is a tun-like device for reading packets from system
@@ -25,8 +26,99 @@ type Device interface {
 	DeviceType() string
 }
 
+// BatchSize is the number of packets read or written in a single batched call
+// when the underlying Device supports it, e.g. WinTun's session-based ring.
+const BatchSize = 64
+
+// BatchReader is implemented by devices that can fill several packet buffers
+// in a single call.
+type BatchReader interface {
+	ReadBatch(bufs [][]byte, sizes []int) (n int, err error)
+}
+
+// BatchWriter is implemented by devices that can flush several packets in a
+// single call.
+type BatchWriter interface {
+	WriteBatch(bufs [][]byte) (int, error)
+}
+
+// PacketIO abstracts over how an Endpoint's backend delivers packets, so the
+// ingest path doesn't need to special-case WinTun's pull-based Reader versus
+// WinDivert's push-based io.WriterTo: headroom is the number of bytes of
+// leading per-backend header ReadPacket expects to read past (always 0 on
+// windows, unlike the unix tun's 4-byte PI prefix).
+type PacketIO interface {
+	// ReadPacket fills buf starting at offset headroom and returns the
+	// payload length and the offset it was written at.
+	ReadPacket(buf []byte, headroom int) (n, offset int, err error)
+}
+
+// wintunPacketIO adapts a WinTun session's Reader to PacketIO.
+type wintunPacketIO struct {
+	r Reader
+}
+
+// ReadPacket is ...
+func (io wintunPacketIO) ReadPacket(buf []byte, headroom int) (int, int, error) {
+	n, err := io.r.Read(buf[headroom:], 0)
+	return n, headroom, err
+}
+
+// windivertIO adapts WinDivert's push-based io.WriterTo delivery to the
+// pull-based PacketIO interface, replacing the unsafe.Pointer cast that used
+// to punt packets straight into a bare channel.Endpoint: run drives wt's
+// WriteTo loop on a goroutine, and every packet it writes is recomputed for
+// correct L4 checksums and queued for ReadPacket to hand off.
+type windivertIO struct {
+	wt   io.WriterTo
+	pkts chan []byte
+}
+
+// newWindivertIO is ...
+func newWindivertIO(wt io.WriterTo) *windivertIO {
+	return &windivertIO{wt: wt, pkts: make(chan []byte, BatchSize)}
+}
+
+// run blocks draining wt until it stops delivering packets, closing pkts so
+// ReadPacket observes io.EOF.
+func (p *windivertIO) run() {
+	p.wt.WriteTo(p)
+	close(p.pkts)
+}
+
+// Write implements io.Writer: WinDivert calls it once per captured packet.
+func (p *windivertIO) Write(b []byte) (int, error) {
+	buf := append([]byte(nil), b...)
+	netutil.RecomputeChecksums(buf)
+	p.pkts <- buf
+	return len(b), nil
+}
+
+// ReadPacket implements PacketIO.
+func (p *windivertIO) ReadPacket(buf []byte, headroom int) (int, int, error) {
+	pkt, ok := <-p.pkts
+	if !ok {
+		return 0, 0, io.EOF
+	}
+	return copy(buf[headroom:], pkt), headroom, nil
+}
+
+// EndpointStats are running packet counters for an Endpoint, useful for
+// observing allocation pressure and drop rates; fetch a consistent snapshot
+// with Endpoint.Stats. Fields are updated with atomic ops and must stay
+// first in Endpoint for 64-bit alignment on 32-bit platforms.
+type EndpointStats struct {
+	PacketsIn  uint64
+	PacketsOut uint64
+	Drops      uint64
+	PoolHits   uint64
+	PoolMisses uint64
+}
+
 // Endpoint is ...
 type Endpoint struct {
+	stats EndpointStats
+
 	// Endpoint is ...
 	*channel.Endpoint
 	// Device is ...
@@ -37,6 +129,106 @@ type Endpoint struct {
 	mtu  int
 	mu   sync.Mutex
 	buff []byte
+
+	io      PacketIO
+	bufPool sync.Pool
+
+	br    BatchReader
+	bw    BatchWriter
+	rbufs [][]byte
+	rsize []int
+
+	gro *netutil.GROTable
+	tso bool
+
+	ingress *netutil.Chain
+	egress  *netutil.Chain
+
+	tap *netutil.Tap
+}
+
+// Stats returns a consistent snapshot of the endpoint's packet counters.
+func (e *Endpoint) Stats() EndpointStats {
+	return EndpointStats{
+		PacketsIn:  atomic.LoadUint64(&e.stats.PacketsIn),
+		PacketsOut: atomic.LoadUint64(&e.stats.PacketsOut),
+		Drops:      atomic.LoadUint64(&e.stats.Drops),
+		PoolHits:   atomic.LoadUint64(&e.stats.PoolHits),
+		PoolMisses: atomic.LoadUint64(&e.stats.PoolMisses),
+	}
+}
+
+// getBuf returns an mtu+4-byte buffer from the pool, allocating a new one on
+// a miss.
+func (e *Endpoint) getBuf() []byte {
+	if v := e.bufPool.Get(); v != nil {
+		atomic.AddUint64(&e.stats.PoolHits, 1)
+		return v.([]byte)
+	}
+	atomic.AddUint64(&e.stats.PoolMisses, 1)
+	return make([]byte, e.mtu+4)
+}
+
+// putBuf returns buf to the pool for reuse by the next read.
+func (e *Endpoint) putBuf(buf []byte) {
+	e.bufPool.Put(buf)
+}
+
+// UseIngressHook registers h to run on every packet before it is injected
+// into the stack, in the order hooks are registered. It now covers WinTun
+// and WinDivert alike, since both deliver through the shared PacketIO path.
+func (e *Endpoint) UseIngressHook(h netutil.PacketHook) {
+	e.ingress.Use(h)
+}
+
+// UseEgressHook registers h to run on every packet before it is written back
+// to the device, in the order hooks are registered. This covers WinTun and
+// WinDivert alike, since both write out through Endpoint.Writer.
+func (e *Endpoint) UseEgressHook(h netutil.PacketHook) {
+	e.egress.Use(h)
+}
+
+// Capabilities reports CapabilityHardwareGSO on top of the embedded
+// channel.Endpoint's capabilities when TSO is enabled, so the stack knows it
+// may hand WriteNotify oversized writes for SegmentTCP to split; without it
+// gVisor never produces anything bigger than mtu and TSO is unreachable.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	caps := e.Endpoint.Capabilities()
+	if e.tso {
+		caps |= stack.CapabilityHardwareGSO
+	}
+	return caps
+}
+
+// GSOMaxSize returns the largest buffer the stack may hand WriteNotify,
+// matching netutil.GROMaxCoalesced so an oversized write never exceeds what
+// SegmentTCP and the GRO path are sized to handle.
+func (e *Endpoint) GSOMaxSize() uint32 {
+	return netutil.GROMaxCoalesced
+}
+
+// Options configures the optional offload behavior NewEndpointWithOffload
+// enables on top of the plain NewEndpoint path.
+type Options struct {
+	// TSOEnabled splits outbound TCP writes larger than mtu into MSS-sized
+	// segments before handing them to the device.
+	TSOEnabled bool
+	// GROEnabled coalesces contiguous inbound TCP segments into a single
+	// packet before injecting them into the stack.
+	GROEnabled bool
+}
+
+// NewEndpointWithOffload is like NewEndpoint but additionally enables TCP
+// segmentation offload and/or generic receive offload as described by opts.
+func NewEndpointWithOffload(dev Device, mtu int, opts Options) stack.LinkEndpoint {
+	ep := NewEndpoint(dev, mtu).(*Endpoint)
+	ep.tso = opts.TSOEnabled
+	if opts.GROEnabled {
+		ep.gro = netutil.NewGROTable(func(buf []byte) {
+			injectInbound(ep.Endpoint, buf, nil)
+		})
+	}
+	return ep
 }
 
 // NewEndpoint is ...
@@ -51,7 +243,32 @@ func NewEndpoint(dev Device, mtu int) stack.LinkEndpoint {
 		Writer:   wt,
 		mtu:      mtu,
 		buff:     make([]byte, mtu),
+		ingress:  netutil.NewChain(),
+		egress:   netutil.NewChain(),
 	}
+
+	// WinTun exposes a Reader; WinDivert only delivers packets by pushing
+	// them through io.WriterTo, so it's wrapped in an adapter that pulls.
+	if r, ok := dev.(Reader); ok {
+		ep.io = wintunPacketIO{r: r}
+	} else if wt, ok := dev.(io.WriterTo); ok {
+		ep.io = newWindivertIO(wt)
+	} else {
+		log.Panic(errors.New("not a valid device for windows"))
+	}
+
+	if br, ok := dev.(BatchReader); ok {
+		ep.br = br
+		ep.rbufs = make([][]byte, BatchSize)
+		ep.rsize = make([]int, BatchSize)
+		for i := range ep.rbufs {
+			ep.rbufs[i] = make([]byte, mtu+4)
+		}
+	}
+	if bw, ok := wt.(BatchWriter); ok {
+		ep.bw = bw
+	}
+
 	ep.Endpoint.AddNotify(ep)
 	return ep
 }
@@ -60,117 +277,186 @@ func NewEndpoint(dev Device, mtu int) stack.LinkEndpoint {
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 	e.Endpoint.Attach(dispatcher)
 
-	// WinDivert has no Reader
-	r, ok := e.Device.(Reader)
-	if !ok {
-		wt, ok := e.Device.(io.WriterTo)
-		if !ok {
-			log.Panic(errors.New("not a valid device for windows"))
-		}
-		go func(w io.Writer, wt io.WriterTo) {
-			if _, err := wt.WriteTo(w); err != nil {
-				return
-			}
-		}((*endpoint)(unsafe.Pointer(e.Endpoint)), wt)
+	if p, ok := e.io.(*windivertIO); ok {
+		go p.run()
+	}
+	if e.br != nil {
+		go e.readBatchLoop()
 		return
 	}
-	// WinTun
-	go func(r Reader, size int, ep *channel.Endpoint) {
+
+	go func(io PacketIO) {
 		for {
-			buf := make([]byte, size)
-			nr, err := r.Read(buf, 0)
+			buf := e.getBuf()
+			n, offset, err := io.ReadPacket(buf, 0)
 			if err != nil {
+				e.putBuf(buf)
 				break
 			}
-			buf = buf[:nr]
-
-			pktBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
-				ReserveHeaderBytes: 0,
-				Payload:            buffer.MakeWithData(buf),
-			})
-			switch header.IPVersion(buf) {
-			case header.IPv4Version:
-				ep.InjectInbound(header.IPv4ProtocolNumber, pktBuffer)
-			case header.IPv6Version:
-				ep.InjectInbound(header.IPv6ProtocolNumber, pktBuffer)
-			}
-			pktBuffer.DecRef()
+			e.inject(buf[offset:offset+n], func() { e.putBuf(buf) })
+		}
+	}(e.io)
+}
+
+// readBatchLoop drains the device's BatchReader and injects every packet it
+// returns; the loop stops on error, matching the single-packet path.
+func (e *Endpoint) readBatchLoop() {
+	for {
+		n, err := e.br.ReadBatch(e.rbufs, e.rsize)
+		if err != nil {
+			break
+		}
+		for i := 0; i < n; i++ {
+			e.inject(e.rbufs[i][:e.rsize[i]], nil)
+		}
+	}
+}
+
+// inject routes an inbound packet through the GRO table when offload is
+// enabled, otherwise injecting it into the stack directly. release, if not
+// nil, is wired to the injected stack.PacketBuffer's OnRelease so buf's
+// backing array (a pool buffer acquired by the caller) is returned for
+// reuse once the stack is done with it.
+//
+// release is nil for readBatchLoop's callers: those buffers are slots in
+// the BatchReader's rbufs ring, which the very next ReadBatch call refills
+// in place, so a buffer handed to the stack without a release hook must be
+// copied first rather than retaining a reference into the ring.
+func (e *Endpoint) inject(buf []byte, release func()) {
+	atomic.AddUint64(&e.stats.PacketsIn, 1)
+	if e.tap != nil {
+		e.tap.Publish(netutil.DirIngress, buf)
+	}
+	switch e.ingress.Run(buf) {
+	case netutil.Drop:
+		atomic.AddUint64(&e.stats.Drops, 1)
+		if release != nil {
+			release()
 		}
-	}(r, e.mtu+4, e.Endpoint)
+		return
+	case netutil.Queue:
+		if release != nil {
+			release()
+		}
+		return
+	}
+	if e.gro != nil && e.gro.Enqueue(buf) {
+		if release != nil {
+			release()
+		}
+		return
+	}
+	if release == nil {
+		buf = append([]byte(nil), buf...)
+	}
+	injectInbound(e.Endpoint, buf, release)
+}
+
+// injectInbound hands a single packet read from the device to the stack.
+// onRelease, if not nil, is called once the stack has released the packet
+// buffer, e.g. to return its backing array to a pool.
+func injectInbound(ep *channel.Endpoint, buf []byte, onRelease func()) {
+	pktBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: 0,
+		Payload:            buffer.MakeWithData(buf),
+		OnRelease:          onRelease,
+	})
+	switch header.IPVersion(buf) {
+	case header.IPv4Version:
+		ep.InjectInbound(header.IPv4ProtocolNumber, pktBuffer)
+	case header.IPv6Version:
+		ep.InjectInbound(header.IPv6ProtocolNumber, pktBuffer)
+	}
+	pktBuffer.DecRef()
 }
 
 // WriteNotify is to write packets back to system
 func (e *Endpoint) WriteNotify() {
+	if e.bw == nil {
+		e.writeOne()
+		return
+	}
+	e.writeBatch()
+}
+
+// writeOne flushes a single packet through Writer, the original path.
+func (e *Endpoint) writeOne() {
 	pkt := e.Endpoint.Read()
 
 	e.mu.Lock()
+	defer e.mu.Unlock()
 	buf := append(e.buff[:0], pkt.NetworkHeader().View().AsSlice()...)
 	buf = append(buf, pkt.TransportHeader().View().AsSlice()...)
 	vv := pkt.Data().ToBuffer()
 	buf = append(buf, vv.Flatten()...)
-	e.Writer.Write(buf)
-	e.mu.Unlock()
-}
 
-// endpoint is for WinDivert
-// write packets from WinDivert to gvisor netstack
-type endpoint struct {
-	Endpoint channel.Endpoint
+	switch e.egress.Run(buf) {
+	case netutil.Drop, netutil.Queue:
+		atomic.AddUint64(&e.stats.Drops, 1)
+		return
+	}
+	if e.tap != nil {
+		e.tap.Publish(netutil.DirEgress, buf)
+	}
+
+	if !e.tso {
+		e.Writer.Write(buf)
+		atomic.AddUint64(&e.stats.PacketsOut, 1)
+		return
+	}
+	for _, seg := range netutil.SegmentTCP(buf, e.mtu) {
+		e.Writer.Write(seg)
+		atomic.AddUint64(&e.stats.PacketsOut, 1)
+	}
 }
 
-// Write is to write packet to stack
-func (e *endpoint) Write(b []byte) (int, error) {
-	buf := append(make([]byte, 0, len(b)), b...)
+// writeBatch drains up to BatchSize queued packets and flushes them through
+// the device's BatchWriter in a single call, drawing each packet's backing
+// array from bufPool like writeOne's single-packet path instead of
+// allocating one per packet; the pooled buffers are returned once
+// WriteBatch has consumed them.
+func (e *Endpoint) writeBatch() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	switch header.IPVersion(buf) {
-	case header.IPv4Version:
-		// WinDivert: need to calculate chekcsum
-		pkt := header.IPv4(buf)
-		pkt.SetChecksum(0)
-		pkt.SetChecksum(^pkt.CalculateChecksum())
-		switch ProtocolNumber := pkt.TransportProtocol(); ProtocolNumber {
-		case header.UDPProtocolNumber:
-			hdr := header.UDP(pkt.Payload())
-			sum := header.PseudoHeaderChecksum(ProtocolNumber, pkt.DestinationAddress(), pkt.SourceAddress(), hdr.Length())
-			sum = checksum.Checksum(hdr.Payload(), sum)
-			hdr.SetChecksum(0)
-			hdr.SetChecksum(^hdr.CalculateChecksum(sum))
-		case header.TCPProtocolNumber:
-			hdr := header.TCP(pkt.Payload())
-			sum := header.PseudoHeaderChecksum(ProtocolNumber, pkt.DestinationAddress(), pkt.SourceAddress(), pkt.PayloadLength())
-			sum = checksum.Checksum(hdr.Payload(), sum)
-			hdr.SetChecksum(0)
-			hdr.SetChecksum(^hdr.CalculateChecksum(sum))
+	bufs := make([][]byte, 0, BatchSize)
+	var pooled [][]byte
+	defer func() {
+		for _, b := range pooled {
+			e.putBuf(b)
 		}
-		pktBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			ReserveHeaderBytes: 0,
-			Payload:            buffer.MakeWithData(buf),
-		})
-		e.Endpoint.InjectInbound(header.IPv4ProtocolNumber, pktBuffer)
-		pktBuffer.DecRef()
-	case header.IPv6Version:
-		// WinDivert: need to calculate chekcsum
-		pkt := header.IPv6(buf)
-		switch ProtocolNumber := pkt.TransportProtocol(); ProtocolNumber {
-		case header.UDPProtocolNumber:
-			hdr := header.UDP(pkt.Payload())
-			sum := header.PseudoHeaderChecksum(ProtocolNumber, pkt.DestinationAddress(), pkt.SourceAddress(), hdr.Length())
-			sum = checksum.Checksum(hdr.Payload(), sum)
-			hdr.SetChecksum(0)
-			hdr.SetChecksum(^hdr.CalculateChecksum(sum))
-		case header.TCPProtocolNumber:
-			hdr := header.TCP(pkt.Payload())
-			sum := header.PseudoHeaderChecksum(ProtocolNumber, pkt.DestinationAddress(), pkt.SourceAddress(), pkt.PayloadLength())
-			sum = checksum.Checksum(hdr.Payload(), sum)
-			hdr.SetChecksum(0)
-			hdr.SetChecksum(^hdr.CalculateChecksum(sum))
+	}()
+
+	for len(bufs) < BatchSize {
+		pkt := e.Endpoint.Read()
+		if pkt == nil {
+			break
 		}
-		pktBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			ReserveHeaderBytes: 0,
-			Payload:            buffer.MakeWithData(buf),
-		})
-		e.Endpoint.InjectInbound(header.IPv6ProtocolNumber, pktBuffer)
-		pktBuffer.DecRef()
+		raw := e.getBuf()
+		pooled = append(pooled, raw)
+		buf := append(raw[:0:cap(raw)], pkt.NetworkHeader().View().AsSlice()...)
+		buf = append(buf, pkt.TransportHeader().View().AsSlice()...)
+		vv := pkt.Data().ToBuffer()
+		buf = append(buf, vv.Flatten()...)
+
+		switch e.egress.Run(buf) {
+		case netutil.Drop, netutil.Queue:
+			atomic.AddUint64(&e.stats.Drops, 1)
+			continue
+		}
+		if e.tap != nil {
+			e.tap.Publish(netutil.DirEgress, buf)
+		}
+
+		if e.tso {
+			bufs = append(bufs, netutil.SegmentTCP(buf, e.mtu)...)
+		} else {
+			bufs = append(bufs, buf)
+		}
+	}
+	if len(bufs) == 0 {
+		return
 	}
-	return len(buf), nil
+	atomic.AddUint64(&e.stats.PacketsOut, uint64(len(bufs)))
+	e.bw.WriteBatch(bufs)
 }